@@ -0,0 +1,304 @@
+// kvbench drives a running KeyValueServer with a configurable mix of
+// Put/Get/Delete traffic from N concurrent client goroutines and reports
+// throughput and latency, modeled on the keep-exercise benchmarking
+// pattern used elsewhere in Arvados-style storage services. It speaks
+// either wire protocol the server supports, so the two can be compared
+// apples-to-apples against the same workload.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "address of the KeyValueServer to benchmark")
+	protocol := flag.String("protocol", "text", "wire protocol to use: text or binary")
+	clients := flag.Int("clients", 10, "number of concurrent client goroutines")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run the benchmark")
+	keyspace := flag.Int("keyspace", 1000, "number of distinct keys to read/write")
+	valueSize := flag.Int("valuesize", 100, "size in bytes of each value written")
+	putRatio := flag.Float64("putratio", 0.3, "fraction of ops that are Put")
+	deleteRatio := flag.Float64("deleteratio", 0.05, "fraction of ops that are Delete; remainder are Get")
+	flag.Parse()
+
+	var newClient func() (benchClient, error)
+	var fillValue func(rng *rand.Rand, value []byte)
+	switch *protocol {
+	case "text":
+		newClient = func() (benchClient, error) { return dialTextClient(*addr) }
+		// The text protocol splits requests on '\n', so a value
+		// containing one desyncs the receiving bufio.Scanner for the
+		// rest of the connection; fillTextSafeValue avoids that byte
+		// entirely so text and binary are actually comparable.
+		fillValue = fillTextSafeValue
+	case "binary":
+		newClient = func() (benchClient, error) { return dialBinaryClient(*addr) }
+		fillValue = func(rng *rand.Rand, value []byte) { rng.Read(value) }
+	default:
+		log.Fatalf("unknown -protocol %q: must be \"text\" or \"binary\"", *protocol)
+	}
+
+	var totalOps int64
+	var droppedOps int64
+	latencies := make([][]time.Duration, *clients)
+
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			cli, err := newClient()
+			if err != nil {
+				log.Printf("worker %d: failed to connect: %v", workerID, err)
+				return
+			}
+			defer cli.Close()
+
+			rng := rand.New(rand.NewSource(int64(workerID) + 1))
+			value := make([]byte, *valueSize)
+			var mine []time.Duration
+			for time.Now().Before(deadline) {
+				key := strconv.Itoa(rng.Intn(*keyspace))
+				roll := rng.Float64()
+
+				start := time.Now()
+				var err error
+				switch {
+				case roll < *putRatio:
+					fillValue(rng, value)
+					err = cli.Put(key, value)
+				case roll < *putRatio+*deleteRatio:
+					err = cli.Delete(key)
+				default:
+					_, err = cli.Get(key)
+				}
+				elapsed := time.Since(start)
+
+				atomic.AddInt64(&totalOps, 1)
+				if err != nil {
+					atomic.AddInt64(&droppedOps, 1)
+					continue
+				}
+				mine = append(mine, elapsed)
+			}
+			latencies[workerID] = mine
+		}(i)
+	}
+	wg.Wait()
+
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	elapsed := time.Since(deadline.Add(-*duration))
+	fmt.Printf("protocol:      %s\n", *protocol)
+	fmt.Printf("clients:       %d\n", *clients)
+	fmt.Printf("duration:      %s\n", elapsed)
+	fmt.Printf("total ops:     %d\n", totalOps)
+	fmt.Printf("dropped ops:   %d\n", droppedOps)
+	fmt.Printf("ops/sec:       %.1f\n", float64(totalOps)/elapsed.Seconds())
+	if len(all) > 0 {
+		fmt.Printf("p50 latency:   %s\n", percentile(all, 0.50))
+		fmt.Printf("p99 latency:   %s\n", percentile(all, 0.99))
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(p * float64(len(sorted)-1))
+	return sorted[idx]
+}
+
+// benchClient is the minimal surface kvbench needs from either protocol.
+type benchClient interface {
+	Put(key string, value []byte) error
+	Get(key string) ([][]byte, error)
+	Delete(key string) error
+	Close() error
+}
+
+// --- text protocol client ---
+
+type textClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTextClient(addr string) (benchClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &textClient{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// textSafeCharset excludes '\n' (and, for good measure, every other
+// control byte) so a value built from it can never desync the server's
+// line-oriented text protocol the way a fully random byte slice would.
+const textSafeCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// fillTextSafeValue fills value with random bytes drawn only from
+// textSafeCharset, for use with the text-protocol client.
+func fillTextSafeValue(rng *rand.Rand, value []byte) {
+	for i := range value {
+		value[i] = textSafeCharset[rng.Intn(len(textSafeCharset))]
+	}
+}
+
+func (c *textClient) Put(key string, value []byte) error {
+	_, err := fmt.Fprintf(c.conn, "Put:%s:%s\n", key, value)
+	return err
+}
+
+func (c *textClient) Delete(key string) error {
+	_, err := fmt.Fprintf(c.conn, "Delete:%s\n", key)
+	return err
+}
+
+func (c *textClient) Get(key string) ([][]byte, error) {
+	if _, err := fmt.Fprintf(c.conn, "Get:%s\n", key); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{[]byte(line)}, nil
+}
+
+func (c *textClient) Close() error { return c.conn.Close() }
+
+// --- binary protocol client ---
+//
+// Mirrors the frame layout implemented by p0partA's ProtocolBinary codec:
+// request [4-byte length][op code][varint key len][key][varint value
+// len][value], response [4-byte length][status byte][payload].
+
+const (
+	opPut    byte = 1
+	opGet    byte = 2
+	opDelete byte = 3
+)
+
+type binaryClient struct {
+	conn net.Conn
+}
+
+func dialBinaryClient(addr string) (benchClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryClient{conn: conn}, nil
+}
+
+func (c *binaryClient) writeFrame(opCode byte, fields ...[]byte) error {
+	var body bytes.Buffer
+	body.WriteByte(opCode)
+	var varintBuf [binary.MaxVarintLen64]byte
+	for _, field := range fields {
+		n := binary.PutUvarint(varintBuf[:], uint64(len(field)))
+		body.Write(varintBuf[:n])
+		body.Write(field)
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(body.Len()))
+	if _, err := c.conn.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(body.Bytes())
+	return err
+}
+
+func (c *binaryClient) readFrame() (status byte, payload []byte, err error) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(c.conn, lenBuf[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return 0, nil, err
+	}
+	if len(body) == 0 {
+		return 0, nil, fmt.Errorf("empty response frame")
+	}
+	return body[0], body[1:], nil
+}
+
+func (c *binaryClient) Put(key string, value []byte) error {
+	if err := c.writeFrame(opPut, []byte(key), value); err != nil {
+		return err
+	}
+	status, _, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("put failed")
+	}
+	return nil
+}
+
+func (c *binaryClient) Delete(key string) error {
+	if err := c.writeFrame(opDelete, []byte(key)); err != nil {
+		return err
+	}
+	status, _, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("delete failed")
+	}
+	return nil
+}
+
+func (c *binaryClient) Get(key string) ([][]byte, error) {
+	if err := c.writeFrame(opGet, []byte(key)); err != nil {
+		return nil, err
+	}
+	status, payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("get failed")
+	}
+	r := bytes.NewReader(payload)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (c *binaryClient) Close() error { return c.conn.Close() }
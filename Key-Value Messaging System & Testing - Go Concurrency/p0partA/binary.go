@@ -0,0 +1,199 @@
+package p0partA
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Binary protocol op codes, one per byte following the 4-byte frame
+// length. Request frame: [4-byte big-endian length][op code][varint key
+// len][key][varint value len][value]; Update additionally carries an old
+// value before the new one.
+const (
+	binOpPut    byte = 1
+	binOpGet    byte = 2
+	binOpDelete byte = 3
+	binOpUpdate byte = 4
+)
+
+// Response frame: [4-byte big-endian length][status byte][payload].
+const (
+	binStatusOK    byte = 0
+	binStatusError byte = 1
+)
+
+// maxFrameSize bounds how large a single request frame's declared length
+// may be before readBinaryFrame refuses it. The whole point of this
+// protocol over the text one is dropping the scanner's implicit
+// line-length cap, but an unbounded replacement just moves the problem:
+// without this, a single 4-byte length header claiming close to 4 GiB
+// would make readBinaryFrame allocate that much before ever reading the
+// body.
+const maxFrameSize = 1 << 20 // 1 MiB
+
+// readRoutineBinary is the ProtocolBinary counterpart to readRoutine: it
+// speaks the length-prefixed framing instead of colon-split text lines,
+// but otherwise submits the same *dbOperation values through
+// kvs.dbRequest, so mainRoutine doesn't need to know which protocol a
+// connection is using.
+func (kvs *keyValueServer) readRoutineBinary(cli *client) {
+	defer func() {
+		select {
+		case kvs.removeClient <- cli.conn:
+		case <-kvs.shutdown:
+		case <-cli.done:
+		}
+	}()
+	for {
+		op, err := readBinaryFrame(cli.conn)
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-cli.done:
+			return
+		case <-kvs.shutdown:
+			return
+		default:
+		}
+
+		if kvs.raftNode != nil {
+			if isLeader, _ := kvs.raftNode.Leader(); !isLeader {
+				kvs.enqueueBinary(cli, binStatusError, nil)
+				continue
+			}
+		}
+
+		select {
+		case kvs.dbRequest <- op:
+		case <-kvs.shutdown:
+			return
+		case <-cli.done:
+			return
+		}
+
+		if op.opType != "Get" {
+			kvs.enqueueBinary(cli, binStatusOK, nil)
+			continue
+		}
+		select {
+		case values := <-op.response:
+			kvs.enqueueBinary(cli, binStatusOK, encodeBinaryValues(values))
+		case <-kvs.shutdown:
+			return
+		case <-cli.done:
+			return
+		}
+	}
+}
+
+// readBinaryFrame reads and decodes one request frame from conn.
+func readBinaryFrame(conn io.Reader) (*dbOperation, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	frameLen := binary.BigEndian.Uint32(lenBuf[:])
+	if frameLen > maxFrameSize {
+		return nil, fmt.Errorf("binary protocol: frame length %d exceeds maximum %d", frameLen, maxFrameSize)
+	}
+	body := make([]byte, frameLen)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("binary protocol: empty frame")
+	}
+
+	r := bytes.NewReader(body[1:])
+	switch body[0] {
+	case binOpPut:
+		key, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		return &dbOperation{opType: "Put", key: string(key), value: value}, nil
+
+	case binOpGet:
+		key, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		return &dbOperation{opType: "Get", key: string(key), response: make(chan [][]byte, 1)}, nil
+
+	case binOpDelete:
+		key, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		return &dbOperation{opType: "Delete", key: string(key)}, nil
+
+	case binOpUpdate:
+		key, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		oldValue, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		newValue, err := readBinaryField(r)
+		if err != nil {
+			return nil, err
+		}
+		return &dbOperation{opType: "Update", key: string(key), oldValue: oldValue, newValue: newValue}, nil
+
+	default:
+		return nil, fmt.Errorf("binary protocol: unknown op code %d", body[0])
+	}
+}
+
+func readBinaryField(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// encodeBinaryValues builds a Get response payload: varint count followed
+// by a varint-length-prefixed copy of each value.
+func encodeBinaryValues(values [][]byte) []byte {
+	var buf bytes.Buffer
+	var varintBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varintBuf[:], uint64(len(values)))
+	buf.Write(varintBuf[:n])
+	for _, value := range values {
+		n := binary.PutUvarint(varintBuf[:], uint64(len(value)))
+		buf.Write(varintBuf[:n])
+		buf.Write(value)
+	}
+	return buf.Bytes()
+}
+
+// enqueueBinary frames status and payload and drops it on the existing
+// "output queue full -> drop" policy if cli can't keep up.
+func (kvs *keyValueServer) enqueueBinary(cli *client, status byte, payload []byte) {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(1+len(payload)))
+	var frame bytes.Buffer
+	frame.Write(lenBuf[:])
+	frame.WriteByte(status)
+	frame.Write(payload)
+	select {
+	case cli.outQueue <- frame.String():
+	default:
+		// Output queue full, drop message (slow client handling)
+	}
+}
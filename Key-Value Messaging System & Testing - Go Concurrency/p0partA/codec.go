@@ -0,0 +1,32 @@
+package p0partA
+
+// Protocol selects the wire format a KeyValueServer speaks to its
+// clients. mainRoutine, dbOperation and the store are unaffected by this
+// choice; only the per-connection read/write goroutines differ.
+type Protocol int
+
+const (
+	// ProtocolText is the original bufio.Scanner/colon-split protocol
+	// ("Put:key:value\n" and friends). It is the default.
+	ProtocolText Protocol = iota
+	// ProtocolBinary is a length-prefixed framing that can carry binary
+	// keys/values containing '\n' or ':' and has no implicit line-length
+	// cap. It only supports the core Put/Get/Delete/Update operations;
+	// leases, Txn and Watch remain text-protocol only.
+	ProtocolBinary
+)
+
+// Option configures optional behavior on a KeyValueServer at construction
+// time, passed to New or NewReplicated.
+type Option func(*keyValueServer)
+
+// WithProtocol selects the wire protocol a server speaks to its clients.
+func WithProtocol(p Protocol) Option {
+	return func(kvs *keyValueServer) { kvs.protocol = p }
+}
+
+func (kvs *keyValueServer) applyOptions(opts []Option) {
+	for _, opt := range opts {
+		opt(kvs)
+	}
+}
@@ -0,0 +1,322 @@
+package p0partA
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lease is a grant that keeps a set of keys alive until ttl elapses since
+// the last grant or keep-alive, modeled on etcd's lease API.
+type lease struct {
+	id      int64
+	ttl     time.Duration
+	expiry  time.Time
+	keys    map[string]struct{}
+	heapIdx int // position in leaseHeap, maintained by container/heap
+}
+
+// leaseHeap is a min-heap of *lease ordered by expiry, letting mainRoutine
+// find the next lease to expire in O(1) and reschedule in O(log n).
+type leaseHeap []*lease
+
+func (h leaseHeap) Len() int            { return len(h) }
+func (h leaseHeap) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+
+func (h *leaseHeap) Push(x interface{}) {
+	l := x.(*lease)
+	l.heapIdx = len(*h)
+	*h = append(*h, l)
+}
+
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	l := old[n-1]
+	old[n-1] = nil
+	l.heapIdx = -1
+	*h = old[:n-1]
+	return l
+}
+
+// leaseOperation is sent on leaseRequest and handled by mainRoutine, which
+// owns kvs.leases and kvs.leaseExpiry alongside kvs.store.
+type leaseOperation struct {
+	opType     string // "Grant", "Revoke", "KeepAlive", "Attach"
+	leaseID    int64
+	ttlSeconds int
+	key        string     // for "Attach": the key this lease now covers
+	response   chan int64 // Grant: returns the new lease id; others: 1 for ok, 0 for not found
+}
+
+// handleLeaseOp services a leaseOperation. Caller (mainRoutine) must hold
+// no locks; kvs.leases/kvs.leaseHeap are only ever touched here.
+func (kvs *keyValueServer) handleLeaseOp(op *leaseOperation) {
+	switch op.opType {
+	case "Grant":
+		kvs.nextLeaseID++
+		l := &lease{
+			id:     kvs.nextLeaseID,
+			ttl:    time.Duration(op.ttlSeconds) * time.Second,
+			expiry: time.Now().Add(time.Duration(op.ttlSeconds) * time.Second),
+			keys:   make(map[string]struct{}),
+		}
+		kvs.leases[l.id] = l
+		heap.Push(&kvs.leaseHeap, l)
+		kvs.rescheduleLeaseTimer()
+		if op.response != nil {
+			op.response <- l.id
+		}
+
+	case "Attach":
+		l, ok := kvs.leases[op.leaseID]
+		if ok {
+			l.keys[op.key] = struct{}{}
+		}
+		if op.response != nil {
+			if ok {
+				op.response <- 1
+			} else {
+				op.response <- 0
+			}
+		}
+
+	case "KeepAlive":
+		l, ok := kvs.leases[op.leaseID]
+		if ok {
+			l.expiry = time.Now().Add(l.ttl)
+			heap.Fix(&kvs.leaseHeap, l.heapIdx)
+			kvs.rescheduleLeaseTimer()
+		}
+		if op.response != nil {
+			if ok {
+				op.response <- 1
+			} else {
+				op.response <- 0
+			}
+		}
+
+	case "Revoke":
+		l, ok := kvs.leases[op.leaseID]
+		if ok {
+			kvs.expireLease(l)
+			kvs.rescheduleLeaseTimer()
+		}
+		if op.response != nil {
+			if ok {
+				op.response <- 1
+			} else {
+				op.response <- 0
+			}
+		}
+	}
+}
+
+// expireLease deletes every key the lease covers and removes it from the
+// heap and the leases map. It is idempotent: revoking or re-expiring an
+// already-gone lease is a no-op, so keep-alive/expiry/revoke races can
+// never double-delete a key. In replicated mode the deletes go through
+// kvs.raftNode.Submit (see submitOp) exactly like a client-issued Delete,
+// instead of applying straight to kvs.store - otherwise a lease's expiry
+// would only ever take effect on whichever node's timer happened to fire,
+// leaving followers (and a future leader after failover) with a stale
+// copy of the key.
+func (kvs *keyValueServer) expireLease(l *lease) {
+	if _, ok := kvs.leases[l.id]; !ok {
+		return
+	}
+	for key := range l.keys {
+		op := &dbOperation{opType: "Delete", key: key}
+		if kvs.raftNode == nil {
+			kvs.applyOp(op)
+		} else {
+			kvs.submitOp(op)
+		}
+	}
+	if l.heapIdx >= 0 {
+		heap.Remove(&kvs.leaseHeap, l.heapIdx)
+	}
+	delete(kvs.leases, l.id)
+}
+
+// expireDueLeases pops and expires every lease whose expiry has passed.
+// Called when kvs.leaseTimerC fires.
+func (kvs *keyValueServer) expireDueLeases() {
+	now := time.Now()
+	for kvs.leaseHeap.Len() > 0 && !kvs.leaseHeap[0].expiry.After(now) {
+		kvs.expireLease(kvs.leaseHeap[0])
+	}
+	kvs.rescheduleLeaseTimer()
+}
+
+// rescheduleLeaseTimer arms kvs.leaseTimerC to fire when the
+// soonest-expiring lease is due, or leaves it disarmed (nil) when there
+// are no leases left.
+func (kvs *keyValueServer) rescheduleLeaseTimer() {
+	if kvs.leaseTimer != nil {
+		kvs.leaseTimer.Stop()
+	}
+	if kvs.leaseHeap.Len() == 0 {
+		kvs.leaseTimer = nil
+		kvs.leaseTimerC = nil
+		return
+	}
+	d := time.Until(kvs.leaseHeap[0].expiry)
+	if d < 0 {
+		d = 0
+	}
+	kvs.leaseTimer = time.NewTimer(d)
+	kvs.leaseTimerC = kvs.leaseTimer.C
+}
+
+// parseLeaseCommand recognizes the lease protocol commands and, if line
+// matches one, returns the leaseOperation to submit and true.
+func parseLeaseCommand(parts []string) (*leaseOperation, bool) {
+	switch parts[0] {
+	case "LeaseGrant":
+		if len(parts) < 2 {
+			return nil, false
+		}
+		ttl, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, false
+		}
+		return &leaseOperation{opType: "Grant", ttlSeconds: ttl, response: make(chan int64, 1)}, true
+
+	case "LeaseRevoke":
+		if len(parts) < 2 {
+			return nil, false
+		}
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &leaseOperation{opType: "Revoke", leaseID: id, response: make(chan int64, 1)}, true
+
+	case "LeaseKeepAlive":
+		if len(parts) < 2 {
+			return nil, false
+		}
+		id, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &leaseOperation{opType: "KeepAlive", leaseID: id, response: make(chan int64, 1)}, true
+	}
+	return nil, false
+}
+
+// leaseResponseLine formats the reply for a lease command's result.
+func leaseResponseLine(cmd string, result int64) string {
+	switch cmd {
+	case "LeaseGrant":
+		return fmt.Sprintf("LeaseID:%d\n", result)
+	case "LeaseRevoke":
+		return fmt.Sprintf("LeaseRevoke:%s\n", okOrNotFound(result))
+	case "LeaseKeepAlive":
+		return fmt.Sprintf("LeaseKeepAlive:%s\n", okOrNotFound(result))
+	}
+	return ""
+}
+
+func okOrNotFound(result int64) string {
+	if result == 1 {
+		return "ok"
+	}
+	return "notfound"
+}
+
+// handleLeaseCommand submits a parsed LeaseGrant/LeaseRevoke/LeaseKeepAlive
+// operation to mainRoutine and relays the result to cli.
+func (kvs *keyValueServer) handleLeaseCommand(cli *client, cmd string, op *leaseOperation) {
+	if kvs.raftNode != nil {
+		if isLeader, leaderID := kvs.raftNode.Leader(); !isLeader {
+			leaderAddr := kvs.peerAddrs[leaderID]
+			select {
+			case cli.outQueue <- fmt.Sprintf("Leader:%s\n", leaderAddr):
+			default:
+			}
+			return
+		}
+	}
+	select {
+	case kvs.leaseRequest <- op:
+	case <-kvs.shutdown:
+		return
+	case <-cli.done:
+		return
+	}
+	select {
+	case result := <-op.response:
+		select {
+		case cli.outQueue <- leaseResponseLine(cmd, result):
+		default:
+			// Output queue full, drop message (slow client handling)
+		}
+	case <-kvs.shutdown:
+	case <-cli.done:
+	}
+}
+
+// handlePutLease submits the underlying Put and then attaches key to
+// leaseID so the lease's expiry (or revocation) deletes it later.
+func (kvs *keyValueServer) handlePutLease(cli *client, putOp *dbOperation, leaseID int64) {
+	if kvs.raftNode != nil {
+		if isLeader, leaderID := kvs.raftNode.Leader(); !isLeader {
+			leaderAddr := kvs.peerAddrs[leaderID]
+			select {
+			case cli.outQueue <- fmt.Sprintf("Leader:%s\n", leaderAddr):
+			default:
+			}
+			return
+		}
+	}
+	select {
+	case kvs.dbRequest <- putOp:
+	case <-kvs.shutdown:
+		return
+	case <-cli.done:
+		return
+	}
+	attach := &leaseOperation{opType: "Attach", leaseID: leaseID, key: putOp.key, response: make(chan int64, 1)}
+	select {
+	case kvs.leaseRequest <- attach:
+	case <-kvs.shutdown:
+		return
+	case <-cli.done:
+		return
+	}
+	select {
+	case result := <-attach.response:
+		line := "PutLease:ok\n"
+		if result == 0 {
+			line = "PutLease:notfound\n"
+		}
+		select {
+		case cli.outQueue <- line:
+		default:
+		}
+	case <-kvs.shutdown:
+	case <-cli.done:
+	}
+}
+
+// parsePutLease recognizes "PutLease:key:leaseID:value" and returns the
+// underlying Put dbOperation plus the lease id to attach the key to.
+func parsePutLease(parts []string) (op *dbOperation, leaseID int64, ok bool) {
+	if parts[0] != "PutLease" || len(parts) < 4 {
+		return nil, 0, false
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, 0, false
+	}
+	return &dbOperation{opType: "Put", key: parts[1], value: []byte(strings.Join(parts[3:], ":"))}, id, true
+}
@@ -0,0 +1,154 @@
+// Tests for the lease (TTL) subsystem.
+package p0partA
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeStore is a minimal kvstore.KVStore good enough to drive mainRoutine
+// in these tests. Like the real store, it is only ever touched from
+// mainRoutine (via applyOp), so it needs no locking of its own; tests
+// must go through the channel-based dbRequest/leaseRequest API below
+// rather than reading fakeStore.data directly from the test goroutine.
+type fakeStore struct {
+	data map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{data: make(map[string][]byte)}
+}
+
+func (s *fakeStore) Put(key string, value []byte) {
+	s.data[key] = value
+}
+
+func (s *fakeStore) Get(key string) [][]byte {
+	if v, ok := s.data[key]; ok {
+		return [][]byte{v}
+	}
+	return nil
+}
+
+func (s *fakeStore) Delete(key string) {
+	delete(s.data, key)
+}
+
+func (s *fakeStore) Update(key string, oldValue, newValue []byte) {
+	s.data[key] = newValue
+}
+
+// newTestServer starts mainRoutine directly against a fakeStore, skipping
+// Start's real TCP listener since these tests only exercise
+// leaseRequest/dbRequest.
+func newTestServer() *keyValueServer {
+	kvs := New(newFakeStore()).(*keyValueServer)
+	go kvs.mainRoutine()
+	return kvs
+}
+
+func grantLease(kvs *keyValueServer, ttlSeconds int) int64 {
+	resp := make(chan int64, 1)
+	kvs.leaseRequest <- &leaseOperation{opType: "Grant", ttlSeconds: ttlSeconds, response: resp}
+	return <-resp
+}
+
+func attachKey(kvs *keyValueServer, leaseID int64, key string) int64 {
+	resp := make(chan int64, 1)
+	kvs.leaseRequest <- &leaseOperation{opType: "Attach", leaseID: leaseID, key: key, response: resp}
+	return <-resp
+}
+
+func revokeLease(kvs *keyValueServer, leaseID int64) int64 {
+	resp := make(chan int64, 1)
+	kvs.leaseRequest <- &leaseOperation{opType: "Revoke", leaseID: leaseID, response: resp}
+	return <-resp
+}
+
+func putKey(kvs *keyValueServer, key string, value []byte) {
+	kvs.dbRequest <- &dbOperation{opType: "Put", key: key, value: value}
+}
+
+func getKey(kvs *keyValueServer, key string) [][]byte {
+	resp := make(chan [][]byte, 1)
+	kvs.dbRequest <- &dbOperation{opType: "Get", key: key, response: resp}
+	return <-resp
+}
+
+func TestLeaseExpiryTiming(t *testing.T) {
+	kvs := newTestServer()
+	defer kvs.Close()
+
+	id := grantLease(kvs, 1)
+	if attachKey(kvs, id, "k") != 1 {
+		t.Fatal("expected Attach to succeed")
+	}
+	putKey(kvs, "k", []byte("v"))
+
+	if values := getKey(kvs, "k"); len(values) != 1 {
+		t.Fatalf("expected key to exist before lease expiry, got %v", values)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if values := getKey(kvs, "k"); len(values) != 0 {
+		t.Fatalf("expected key to be gone after lease expiry, got %v", values)
+	}
+}
+
+func TestLeaseRevokeIdempotency(t *testing.T) {
+	kvs := newTestServer()
+	defer kvs.Close()
+
+	id := grantLease(kvs, 60)
+	if attachKey(kvs, id, "k") != 1 {
+		t.Fatal("expected Attach to succeed")
+	}
+	putKey(kvs, "k", []byte("v"))
+
+	if revokeLease(kvs, id) != 1 {
+		t.Fatal("expected first Revoke to report ok")
+	}
+	if values := getKey(kvs, "k"); len(values) != 0 {
+		t.Fatalf("expected key to be gone after Revoke, got %v", values)
+	}
+
+	// Revoking an already-gone lease must be a no-op, not a second delete
+	// of keys it used to cover or a panic on its already-removed heap
+	// entry.
+	if revokeLease(kvs, id) != 0 {
+		t.Fatal("expected second Revoke of the same lease to report notfound")
+	}
+}
+
+func TestLeaseMassExpiry(t *testing.T) {
+	kvs := newTestServer()
+	defer kvs.Close()
+
+	const numKeys = 200
+	id := grantLease(kvs, 1)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if attachKey(kvs, id, key) != 1 {
+			t.Fatalf("expected Attach to succeed for %s", key)
+		}
+		putKey(kvs, key, []byte("v"))
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if values := getKey(kvs, key); len(values) != 1 {
+			t.Fatalf("expected %s to exist before lease expiry, got %v", key, values)
+		}
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if values := getKey(kvs, key); len(values) != 0 {
+			t.Fatalf("expected %s to be gone after mass expiry, got %v", key, values)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+// Package raft implements a single-group Raft consensus module used to
+// replicate keyValueServer mutations across several KeyValueServer
+// instances. It covers leader election, log replication and the commit
+// safety rules from the Raft paper; transport is pluggable via the Peer
+// interface so callers can wire it over any RPC mechanism.
+package raft
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State is the role a Node currently plays in the group.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+const (
+	minElectionTimeoutMillis = 150
+	maxElectionTimeoutMillis = 300
+	heartbeatInterval        = 50 * time.Millisecond
+
+	// leaseDuration bounds how long a leader may answer Leader()/reads
+	// affirmatively after its most recent confirmed quorum contact. It is
+	// kept below minElectionTimeoutMillis so a leader cut off by a
+	// partition always lets its lease lapse before any follower on the
+	// other side could legally finish an election, ruling out two nodes
+	// simultaneously believing themselves to hold a live lease.
+	leaseDuration = (minElectionTimeoutMillis * 3 / 4) * time.Millisecond
+)
+
+// LogEntry is a single replicated command together with the term it was
+// appended in.
+type LogEntry struct {
+	Term    int
+	Index   int
+	Command []byte
+}
+
+// Peer is the RPC surface a Node needs from every other member of the
+// group. Implementations typically wrap a net/rpc client dialed to the
+// peer's Raft transport address.
+type Peer interface {
+	RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error
+}
+
+// RequestVoteArgs is the RequestVote RPC request.
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+// RequestVoteReply is the RequestVote RPC response.
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+// AppendEntriesArgs is the AppendEntries RPC request; an empty Entries
+// slice is a heartbeat.
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []LogEntry
+	LeaderCommit int
+}
+
+// AppendEntriesReply is the AppendEntries RPC response. ConflictIndex and
+// ConflictTerm let the leader back up a follower's nextIndex in a single
+// round trip instead of one term at a time.
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int
+	ConflictTerm  int
+}
+
+// Node is one member of a Raft group.
+type Node struct {
+	mu sync.Mutex
+
+	id    int
+	peers map[int]Peer // does not include this node's own id
+
+	state       State
+	currentTerm int
+	votedFor    int
+	log         []LogEntry // log[0] is a sentinel; real entries start at index 1
+
+	commitIndex int
+	lastApplied int
+
+	nextIndex  map[int]int
+	matchIndex map[int]int
+
+	leaderID int
+
+	lastHeardFromLeader time.Time
+
+	// leaseValidUntil is how long this node may still answer Leader() (and
+	// thus serve linearizable reads) as the confirmed leader, last
+	// extended by replicateToPeers on a quorum-contacted round. See
+	// leaseDuration.
+	leaseValidUntil time.Time
+
+	// ApplyCh delivers committed entries in order; mainRoutine-equivalent
+	// callers should range over it and apply each entry to their store.
+	ApplyCh chan LogEntry
+
+	shutdown chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a Raft node for the group described by peers (which must not
+// include id). The node starts as a Follower and does not begin ticking
+// until Start is called.
+func New(id int, peers map[int]Peer) *Node {
+	return &Node{
+		id:         id,
+		peers:      peers,
+		state:      Follower,
+		votedFor:   -1,
+		log:        []LogEntry{{}},
+		nextIndex:  make(map[int]int),
+		matchIndex: make(map[int]int),
+		leaderID:   -1,
+		ApplyCh:    make(chan LogEntry, 256),
+		shutdown:   make(chan struct{}),
+	}
+}
+
+// Start begins the election timer goroutine.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.lastHeardFromLeader = time.Now()
+	n.mu.Unlock()
+	go n.electionTimerRoutine()
+}
+
+// Stop halts all background goroutines for this node.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() { close(n.shutdown) })
+}
+
+// Leader reports whether this node currently believes itself to be the
+// group leader with a live lease, and if not, which peer id it believes
+// is. A node that is locally still in the Leader state but whose lease
+// has lapsed (no quorum contact confirmed recently enough, e.g. because
+// it is on the minority side of a partition) reports false here even
+// though electionTimerRoutine may not yet have stepped it down, so reads
+// stop being served from stale local state the moment the lease expires.
+func (n *Node) Leader() (isLeader bool, leaderID int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == Leader && time.Now().Before(n.leaseValidUntil) {
+		return true, n.leaderID
+	}
+	return false, n.leaderID
+}
+
+// Submit appends command to the leader's log and returns the index and
+// term it was assigned. Callers must watch ApplyCh to learn when (or
+// whether) the entry actually commits; a successful Submit is not itself
+// a durability guarantee, since the leader can still lose an election
+// before replicating the entry to a majority.
+func (n *Node) Submit(command []byte) (index int, term int, isLeader bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader {
+		return 0, 0, false
+	}
+	entry := LogEntry{Term: n.currentTerm, Index: len(n.log), Command: command}
+	n.log = append(n.log, entry)
+	n.matchIndex[n.id] = entry.Index
+	go n.replicateToPeers()
+	return entry.Index, entry.Term, true
+}
+
+func randomElectionTimeout() time.Duration {
+	span := maxElectionTimeoutMillis - minElectionTimeoutMillis
+	return time.Duration(minElectionTimeoutMillis+rand.Intn(span+1)) * time.Millisecond
+}
+
+// electionTimerRoutine fires a new election whenever a follower or
+// candidate goes too long without hearing from a leader, and steps a
+// Leader down to Follower once its lease lapses without a renewed
+// quorum-contacted round (see leaseDuration) - the case of a leader
+// stranded on the minority side of a partition, which would otherwise
+// never be contradicted into stepping down on its own.
+func (n *Node) electionTimerRoutine() {
+	timeout := randomElectionTimeout()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.shutdown:
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			state := n.state
+			elapsed := time.Since(n.lastHeardFromLeader)
+			if state == Leader && time.Now().After(n.leaseValidUntil) {
+				n.state = Follower
+				n.leaderID = -1
+			}
+			n.mu.Unlock()
+			if state != Leader && elapsed >= timeout {
+				timeout = randomElectionTimeout()
+				go n.startElection()
+			}
+		}
+	}
+}
+
+func (n *Node) lastLogIndexAndTerm() (int, int) {
+	last := n.log[len(n.log)-1]
+	return last.Index, last.Term
+}
+
+// startElection converts this node to a Candidate and requests votes from
+// every peer, becoming Leader if a majority (including itself) grants.
+func (n *Node) startElection() {
+	n.mu.Lock()
+	n.state = Candidate
+	n.currentTerm++
+	n.votedFor = n.id
+	n.lastHeardFromLeader = time.Now()
+	term := n.currentTerm
+	lastLogIndex, lastLogTerm := n.lastLogIndexAndTerm()
+	peers := n.peers
+	n.mu.Unlock()
+
+	votes := 1 // vote for self
+	var mu sync.Mutex
+	majority := len(peers)/2 + 1
+
+	var wg sync.WaitGroup
+	for peerID, peer := range peers {
+		wg.Add(1)
+		go func(peerID int, peer Peer) {
+			defer wg.Done()
+			args := &RequestVoteArgs{
+				Term:         term,
+				CandidateID:  n.id,
+				LastLogIndex: lastLogIndex,
+				LastLogTerm:  lastLogTerm,
+			}
+			reply := &RequestVoteReply{}
+			if err := peer.RequestVote(args, reply); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.currentTerm {
+				n.becomeFollower(reply.Term)
+				return
+			}
+			if reply.VoteGranted && n.state == Candidate && n.currentTerm == term {
+				mu.Lock()
+				votes++
+				won := votes >= majority
+				mu.Unlock()
+				if won {
+					n.becomeLeaderLocked()
+				}
+			}
+		}(peerID, peer)
+	}
+	wg.Wait()
+}
+
+// becomeFollower steps down to Follower in a newer term. Caller must hold n.mu.
+func (n *Node) becomeFollower(term int) {
+	n.state = Follower
+	n.currentTerm = term
+	n.votedFor = -1
+	n.lastHeardFromLeader = time.Now()
+}
+
+// becomeLeaderLocked promotes this node to Leader and starts the
+// heartbeat/replication loop. Caller must hold n.mu.
+func (n *Node) becomeLeaderLocked() {
+	if n.state != Candidate {
+		return
+	}
+	n.state = Leader
+	n.leaderID = n.id
+	// The election that just won already confirmed majority contact, so
+	// grant an initial lease immediately; replicateToPeers renews it on
+	// every subsequent quorum-contacted round.
+	n.leaseValidUntil = time.Now().Add(leaseDuration)
+	for peerID := range n.peers {
+		n.nextIndex[peerID] = len(n.log)
+		n.matchIndex[peerID] = 0
+	}
+	go n.leaderHeartbeatLoop(n.currentTerm)
+}
+
+func (n *Node) leaderHeartbeatLoop(term int) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		n.mu.Lock()
+		stillLeader := n.state == Leader && n.currentTerm == term
+		n.mu.Unlock()
+		if !stillLeader {
+			return
+		}
+		n.replicateToPeers()
+		select {
+		case <-ticker.C:
+		case <-n.shutdown:
+			return
+		}
+	}
+}
+
+// replicateToPeers sends AppendEntries (heartbeat or with new entries) to
+// every peer, advances commitIndex once a majority has replicated, and
+// renews the leader lease if a majority of peers were reachable and
+// acknowledged this node as leader of the current term.
+func (n *Node) replicateToPeers() {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.currentTerm
+	peers := n.peers
+	n.mu.Unlock()
+
+	var contactMu sync.Mutex
+	contacted := 1 // self
+
+	var wg sync.WaitGroup
+	for peerID, peer := range peers {
+		wg.Add(1)
+		go func(peerID int, peer Peer) {
+			defer wg.Done()
+			if n.replicateToPeer(peerID, peer, term) {
+				contactMu.Lock()
+				contacted++
+				contactMu.Unlock()
+			}
+		}(peerID, peer)
+	}
+	wg.Wait()
+
+	n.mu.Lock()
+	if n.state == Leader && n.currentTerm == term && contacted >= len(n.peers)/2+1 {
+		n.leaseValidUntil = time.Now().Add(leaseDuration)
+	}
+	n.maybeAdvanceCommitIndexLocked()
+	n.mu.Unlock()
+}
+
+// replicateToPeer sends one AppendEntries RPC to peer and reports whether
+// peer was reachable and acknowledged this node's term (regardless of
+// whether the entries themselves were accepted), which is what the lease
+// renewal in replicateToPeers counts as a confirmed quorum contact.
+func (n *Node) replicateToPeer(peerID int, peer Peer, term int) (contacted bool) {
+	n.mu.Lock()
+	if n.state != Leader || n.currentTerm != term {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.nextIndex[peerID]
+	if next < 1 {
+		next = 1
+	}
+	prevLogIndex := next - 1
+	prevLogTerm := n.log[prevLogIndex].Term
+	entries := append([]LogEntry(nil), n.log[next:]...)
+	args := &AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	reply := &AppendEntriesReply{}
+	if err := peer.AppendEntries(args, reply); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.currentTerm {
+		n.becomeFollower(reply.Term)
+		return false
+	}
+	contacted = true
+	if n.state != Leader || n.currentTerm != term {
+		return contacted
+	}
+	if reply.Success {
+		n.matchIndex[peerID] = prevLogIndex + len(entries)
+		n.nextIndex[peerID] = n.matchIndex[peerID] + 1
+		return contacted
+	}
+	// Fast backup using the follower's reported conflict point.
+	if reply.ConflictTerm == 0 {
+		n.nextIndex[peerID] = reply.ConflictIndex
+		return contacted
+	}
+	newNext := reply.ConflictIndex
+	for i := len(n.log) - 1; i >= 1; i-- {
+		if n.log[i].Term == reply.ConflictTerm {
+			newNext = i + 1
+			break
+		}
+	}
+	n.nextIndex[peerID] = newNext
+	return contacted
+}
+
+// maybeAdvanceCommitIndexLocked advances commitIndex to the highest index
+// replicated on a majority of servers, honoring the Raft rule that a
+// leader only commits entries from its own current term directly. Caller
+// must hold n.mu.
+func (n *Node) maybeAdvanceCommitIndexLocked() {
+	majority := len(n.peers)/2 + 1
+	for idx := len(n.log) - 1; idx > n.commitIndex; idx-- {
+		if n.log[idx].Term != n.currentTerm {
+			continue
+		}
+		count := 1 // self
+		for peerID := range n.peers {
+			if n.matchIndex[peerID] >= idx {
+				count++
+			}
+		}
+		if count >= majority {
+			n.commitIndex = idx
+			break
+		}
+	}
+	n.applyCommittedLocked()
+}
+
+func (n *Node) applyCommittedLocked() {
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		entry := n.log[n.lastApplied]
+		select {
+		case n.ApplyCh <- entry:
+		case <-n.shutdown:
+			return
+		}
+	}
+}
+
+// RequestVote handles an incoming RequestVote RPC.
+func (n *Node) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.currentTerm {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.currentTerm
+
+	if args.Term < n.currentTerm {
+		reply.VoteGranted = false
+		return nil
+	}
+
+	lastLogIndex, lastLogTerm := n.lastLogIndexAndTerm()
+	logIsUpToDate := args.LastLogTerm > lastLogTerm ||
+		(args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)
+
+	if (n.votedFor == -1 || n.votedFor == args.CandidateID) && logIsUpToDate {
+		n.votedFor = args.CandidateID
+		n.lastHeardFromLeader = time.Now()
+		reply.VoteGranted = true
+		return nil
+	}
+	reply.VoteGranted = false
+	return nil
+}
+
+// AppendEntries handles an incoming AppendEntries RPC (heartbeat or log
+// replication).
+func (n *Node) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.currentTerm {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.currentTerm
+
+	if args.Term < n.currentTerm {
+		reply.Success = false
+		return nil
+	}
+
+	n.state = Follower
+	n.leaderID = args.LeaderID
+	n.lastHeardFromLeader = time.Now()
+
+	if args.PrevLogIndex >= len(n.log) {
+		reply.Success = false
+		reply.ConflictIndex = len(n.log)
+		reply.ConflictTerm = 0
+		return nil
+	}
+	if args.PrevLogIndex > 0 && n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		conflictTerm := n.log[args.PrevLogIndex].Term
+		conflictIndex := args.PrevLogIndex
+		for conflictIndex > 1 && n.log[conflictIndex-1].Term == conflictTerm {
+			conflictIndex--
+		}
+		reply.Success = false
+		reply.ConflictIndex = conflictIndex
+		reply.ConflictTerm = conflictTerm
+		return nil
+	}
+
+	insertAt := args.PrevLogIndex + 1
+	for i, entry := range args.Entries {
+		idx := insertAt + i
+		if idx < len(n.log) {
+			if n.log[idx].Term != entry.Term {
+				n.log = n.log[:idx]
+				n.log = append(n.log, args.Entries[i:]...)
+				break
+			}
+			continue
+		}
+		n.log = append(n.log, args.Entries[i:]...)
+		break
+	}
+
+	if args.LeaderCommit > n.commitIndex {
+		lastNewIndex := args.PrevLogIndex + len(args.Entries)
+		if args.LeaderCommit < lastNewIndex {
+			n.commitIndex = args.LeaderCommit
+		} else {
+			n.commitIndex = lastNewIndex
+		}
+		n.applyCommittedLocked()
+	}
+
+	reply.Success = true
+	return nil
+}
@@ -0,0 +1,226 @@
+// Tests for the raft consensus module, driving Node directly over an
+// in-process Peer implementation instead of real sockets.
+package raft
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// localPeer implements Peer by calling straight into another Node in the
+// same test process, skipping net/rpc so these tests can exercise
+// election/replication/commit without opening a single socket. setDropped
+// makes every call fail as if the peer were unreachable, for simulating a
+// partition.
+type localPeer struct {
+	mu      sync.RWMutex
+	node    *Node
+	dropped bool
+}
+
+func (p *localPeer) setDropped(dropped bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropped = dropped
+}
+
+func (p *localPeer) isDropped() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dropped
+}
+
+func (p *localPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if p.isDropped() {
+		return fmt.Errorf("peer unreachable")
+	}
+	return p.node.RequestVote(args, reply)
+}
+
+func (p *localPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if p.isDropped() {
+		return fmt.Errorf("peer unreachable")
+	}
+	return p.node.AppendEntries(args, reply)
+}
+
+// newTestCluster wires n Nodes together with localPeer, returning the
+// nodes and peerLinks[i][j], node i's localPeer for node j (nil when
+// i == j). Nodes are constructed before any localPeer can reference one,
+// so every localPeer starts with a nil node and is pointed at its target
+// once the whole cluster exists.
+func newTestCluster(n int) ([]*Node, [][]*localPeer) {
+	peerLinks := make([][]*localPeer, n)
+	for i := 0; i < n; i++ {
+		peerLinks[i] = make([]*localPeer, n)
+		for j := 0; j < n; j++ {
+			if i != j {
+				peerLinks[i][j] = &localPeer{}
+			}
+		}
+	}
+
+	nodes := make([]*Node, n)
+	for i := 0; i < n; i++ {
+		peers := make(map[int]Peer, n-1)
+		for j := 0; j < n; j++ {
+			if i != j {
+				peers[j] = peerLinks[i][j]
+			}
+		}
+		nodes[i] = New(i, peers)
+	}
+
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j {
+				peerLinks[i][j].node = nodes[j]
+			}
+		}
+	}
+	return nodes, peerLinks
+}
+
+func stopAll(nodes []*Node) {
+	for _, n := range nodes {
+		n.Stop()
+	}
+}
+
+// waitForLeader polls until exactly one node reports itself leader, or
+// fails the test once timeout elapses.
+func waitForLeader(t *testing.T, nodes []*Node, timeout time.Duration) *Node {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		for _, n := range nodes {
+			if isLeader, _ := n.Leader(); isLeader {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		if len(leaders) > 1 {
+			t.Fatalf("%d nodes simultaneously believe themselves leader", len(leaders))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected within timeout")
+	return nil
+}
+
+func TestElectsExactlyOneLeader(t *testing.T) {
+	nodes, _ := newTestCluster(3)
+	for _, n := range nodes {
+		n.Start()
+	}
+	defer stopAll(nodes)
+
+	waitForLeader(t, nodes, 2*time.Second)
+}
+
+func TestSubmitReplicatesAndCommitsOnEveryNode(t *testing.T) {
+	nodes, _ := newTestCluster(3)
+	for _, n := range nodes {
+		n.Start()
+	}
+	defer stopAll(nodes)
+
+	leader := waitForLeader(t, nodes, 2*time.Second)
+
+	index, term, isLeader := leader.Submit([]byte("hello"))
+	if !isLeader {
+		t.Fatal("Submit on the elected leader reported isLeader=false")
+	}
+
+	for _, n := range nodes {
+		select {
+		case entry := <-n.ApplyCh:
+			if entry.Index != index || entry.Term != term || string(entry.Command) != "hello" {
+				t.Fatalf("node %d applied %+v, want index=%d term=%d command=hello", n.id, entry, index, term)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("node %d never applied the committed entry", n.id)
+		}
+	}
+}
+
+func TestNonLeaderSubmitFails(t *testing.T) {
+	nodes, _ := newTestCluster(3)
+	for _, n := range nodes {
+		n.Start()
+	}
+	defer stopAll(nodes)
+
+	leader := waitForLeader(t, nodes, 2*time.Second)
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		if _, _, isLeader := n.Submit([]byte("nope")); isLeader {
+			t.Fatalf("node %d accepted a Submit while not leader", n.id)
+		}
+	}
+}
+
+// TestFailoverElectsNewLeaderAndKeepsCommitting partitions the current
+// leader away from the rest of the cluster and checks that (a) the
+// remaining nodes elect a new leader in a later term and (b) that leader
+// can still replicate and commit entries to the survivors.
+func TestFailoverElectsNewLeaderAndKeepsCommitting(t *testing.T) {
+	nodes, peerLinks := newTestCluster(3)
+	for _, n := range nodes {
+		n.Start()
+	}
+	defer stopAll(nodes)
+
+	oldLeader := waitForLeader(t, nodes, 2*time.Second)
+	oldLeaderID := oldLeader.id
+	oldTerm := oldLeader.currentTerm
+
+	// Simulate the old leader's process going away: stop its own
+	// goroutines and sever the link in both directions so no survivor
+	// can reach it (or it them).
+	oldLeader.Stop()
+	for i := range nodes {
+		if i == oldLeaderID {
+			continue
+		}
+		peerLinks[oldLeaderID][i].setDropped(true)
+		peerLinks[i][oldLeaderID].setDropped(true)
+	}
+
+	survivors := make([]*Node, 0, len(nodes)-1)
+	for _, n := range nodes {
+		if n.id != oldLeaderID {
+			survivors = append(survivors, n)
+		}
+	}
+
+	newLeader := waitForLeader(t, survivors, 3*time.Second)
+	if newLeader.id == oldLeaderID {
+		t.Fatal("partitioned-away node was still reported as leader")
+	}
+	if newLeader.currentTerm <= oldTerm {
+		t.Fatalf("expected new leader's term (%d) to exceed the old leader's term (%d)", newLeader.currentTerm, oldTerm)
+	}
+
+	index, _, isLeader := newLeader.Submit([]byte("after-failover"))
+	if !isLeader {
+		t.Fatal("Submit on the new leader reported isLeader=false")
+	}
+	for _, n := range survivors {
+		select {
+		case entry := <-n.ApplyCh:
+			if entry.Index != index || string(entry.Command) != "after-failover" {
+				t.Fatalf("node %d applied %+v, want index=%d command=after-failover", n.id, entry, index)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("node %d never applied the post-failover entry", n.id)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+)
+
+// rpcPeer is a Peer backed by a net/rpc client dialed to another node's
+// Raft transport address.
+type rpcPeer struct {
+	client *rpc.Client
+}
+
+// DialPeer connects to the Raft transport listening at addr and returns a
+// Peer usable in a Node's peer map.
+func DialPeer(addr string) (Peer, error) {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("raft: failed to dial peer at %s: %w", addr, err)
+	}
+	return &rpcPeer{client: client}, nil
+}
+
+func (p *rpcPeer) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return p.client.Call("Node.RequestVote", args, reply)
+}
+
+func (p *rpcPeer) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return p.client.Call("Node.AppendEntries", args, reply)
+}
+
+// Listen opens the raft transport listener on addr. It is split out from
+// Serve so a caller can start accepting connections - and so peers
+// dialing this node stop getting connection-refused - before this node's
+// own Node value (which Serve needs to register) exists yet.
+func Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("raft: failed to listen on %s: %w", addr, err)
+	}
+	return listener, nil
+}
+
+// Serve registers n under net/rpc on listener and begins accepting
+// RequestVote and AppendEntries calls from other group members. listener
+// is typically the result of an earlier call to Listen.
+func Serve(n *Node, listener net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Node", n); err != nil {
+		return fmt.Errorf("raft: failed to register node: %w", err)
+	}
+	go server.Accept(listener)
+	return nil
+}
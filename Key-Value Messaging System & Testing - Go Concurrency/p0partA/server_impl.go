@@ -8,51 +8,160 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/suryatejb/distributed-systems/p0partA/kvstore"
+	"github.com/suryatejb/distributed-systems/p0partA/raft"
 )
 
 const (
 	maxQueueSize = 500 // Maximum buffered messages per client
+
+	// peerDialRetryInterval and peerDialTimeout bound how long
+	// NewReplicated waits for every raft peer to come up during cluster
+	// bring-up. Every node in an N>1 cluster needs every other node's
+	// raft listener up before it can finish NewReplicated, which cannot
+	// all be simultaneously true the instant the process starts, so
+	// dialing retries instead of failing on the first attempt.
+	peerDialRetryInterval = 200 * time.Millisecond
+	peerDialTimeout       = 30 * time.Second
 )
 
 type keyValueServer struct {
-	store        kvstore.KVStore      // Backend key-value store
-	listener     net.Listener         // TCP listener for incoming connections
-	clients      map[net.Conn]*client // Map of active clients
-	addClient    chan net.Conn        // Channel to add new clients
-	removeClient chan net.Conn        // Channel to remove disconnected clients
-	dbRequest    chan *dbOperation    // Channel for database operations
-	countRequest chan *countQuery     // Channel for count queries
-	shutdown     chan struct{}        // Channel for server shutdown
-	countActive  int                  // Number of active clients
-	countDropped int                  // Number of dropped clients
+	store              kvstore.KVStore      // Backend key-value store
+	listener           net.Listener         // TCP listener for incoming connections
+	clients            map[net.Conn]*client // Map of active clients
+	addClient          chan net.Conn        // Channel to add new clients
+	removeClient       chan net.Conn        // Channel to remove disconnected clients
+	dbRequest          chan *dbOperation    // Channel for database operations
+	countRequest       chan *countQuery     // Channel for count queries
+	shutdown           chan struct{}        // Channel for server shutdown
+	countActive        int                  // Number of active clients
+	countDropped       int                  // Number of clients the server force-disconnected
+	countDroppedEvents int                  // Number of watch events dropped due to a slow subscriber
+
+	// Replication. raftNode is nil for a standalone (non-replicated)
+	// server, in which case dbRequest ops are applied to store directly.
+	raftNode   *raft.Node
+	peerAddrs  map[int]string             // raft peer id -> client-facing address, for Leader: redirects
+	raftCommit chan raft.LogEntry         // forwards raftNode.ApplyCh into mainRoutine
+	pendingOps map[int]*pendingSubmission // log index -> op awaiting its apply, owned by mainRoutine
+
+	// Leases. All fields below are only ever touched from mainRoutine. In
+	// replicated mode lease/PutLease commands are redirected away from
+	// followers (see handleLeaseCommand/handlePutLease), so this
+	// bookkeeping only ever exists on the current leader; a failover
+	// leaves the new leader with no memory of leases granted before it
+	// took over. Key deletes on expiry still go through raft (see
+	// expireLease), so the replicated store itself never diverges.
+	leaseRequest chan *leaseOperation // Channel for lease grant/revoke/keepalive/attach
+	leases       map[int64]*lease     // Active leases by id
+	leaseHeap    leaseHeap            // Active leases ordered by expiry
+	nextLeaseID  int64                // Monotonically increasing lease id counter
+	leaseTimer   *time.Timer          // Armed for the soonest lease expiry, nil if none pending
+	leaseTimerC  <-chan time.Time     // leaseTimer.C, or nil when leaseTimer is nil
+
+	// Watches. All fields below are only ever touched from mainRoutine.
+	watchRequest chan *watchOperation             // Channel for Watch/Unwatch/WatchFrom
+	watchers     map[string]map[net.Conn]struct{} // keyPrefix -> subscribed connections
+	eventRing    []watchEvent                     // Bounded history for WatchFrom replay
+	revision     int64                            // Monotonic counter, incremented on each mutation
+
+	protocol Protocol // Wire protocol spoken to clients; see codec.go
 }
 
 type client struct {
-	conn     net.Conn      // TCP connection to client
-	outQueue chan string   // Buffered channel for outgoing messages
-	done     chan struct{} // Signal when client should terminate
+	conn            net.Conn            // TCP connection to client
+	outQueue        chan string         // Buffered channel for outgoing messages
+	done            chan struct{}       // Signal when client should terminate
+	watchedPrefixes map[string]struct{} // Key prefixes this client is subscribed to, owned by mainRoutine
 }
 
 type dbOperation struct {
-	opType   string        // Operation type: Put, Get, Delete, Update
+	opType   string        // Operation type: Put, Get, Delete, Update, Txn
 	key      string        // Key for the operation
 	value    []byte        // Value to set (for Put and Update)
 	oldValue []byte        // Old value (for Update)
 	newValue []byte        // New value (for Update)
 	response chan [][]byte // Channel to return Get results
+
+	// revisionAtRead is filled in by applyOp's Get case with kvs.revision
+	// as of the read, then safe to read back in readRoutine once
+	// op.response has signaled (the channel send/receive is the
+	// synchronization point, so no lock is needed for this field).
+	revisionAtRead int64
+
+	// Txn-only fields; set when opType == "Txn".
+	txnGuards   []txnGuard     // Guards evaluated atomically before picking a branch
+	txnThenOps  []*dbOperation // Ops to apply when every guard passes
+	txnElseOps  []*dbOperation // Ops to apply otherwise
+	txnResponse chan *txnResult
 }
 
-// countQuery handles requests for active/dropped client counts
+// pendingSubmission pairs a dbOperation (or Txn op) awaiting its raft
+// commit with the term it was submitted under. raft log indexes get
+// reused across terms if a leader change overwrites an uncommitted entry,
+// so the raftCommit case in mainRoutine must check this term against the
+// committed entry's term before resolving the waiter - otherwise a client
+// still blocked on a stale submission could be handed an unrelated
+// command's result once a different entry commits at the same index.
+type pendingSubmission struct {
+	term int
+	op   *dbOperation
+}
+
+// countQuery handles requests for active/dropped client/dropped-event counts.
 type countQuery struct {
-	isActive bool     // true for active count, false for dropped count
+	kind     string   // "active", "dropped", or "droppedEvents"
 	response chan int // Channel to return the count
 }
 
-// New creates and returns (but does not start) a new KeyValueServer.
-func New(store kvstore.KVStore) KeyValueServer {
-	return &keyValueServer{
+// New creates and returns (but does not start) a new standalone
+// KeyValueServer. Mutations are applied directly to store. By default the
+// server speaks ProtocolText; pass WithProtocol(ProtocolBinary) to opt
+// into the length-prefixed binary protocol instead.
+func New(store kvstore.KVStore, opts ...Option) KeyValueServer {
+	kvs := &keyValueServer{
+		store:        store,
+		clients:      make(map[net.Conn]*client),
+		addClient:    make(chan net.Conn),
+		removeClient: make(chan net.Conn),
+		dbRequest:    make(chan *dbOperation),
+		countRequest: make(chan *countQuery),
+		shutdown:     make(chan struct{}),
+		leaseRequest: make(chan *leaseOperation),
+		leases:       make(map[int64]*lease),
+		watchRequest: make(chan *watchOperation),
+		watchers:     make(map[string]map[net.Conn]struct{}),
+	}
+	kvs.applyOptions(opts)
+	return kvs
+}
+
+// NewReplicated creates a KeyValueServer whose mutations are linearized
+// through a Raft group. id is this server's raft id, raftPeers maps every
+// other group member's id to its raft transport address (host:port), and
+// peerAddrs maps every member's id (including id itself) to the
+// client-facing address returned in Leader: redirects. Start also brings
+// up the raft transport listener on raftAddr.
+func NewReplicated(store kvstore.KVStore, id int, raftAddr string, raftPeers map[int]string, peerAddrs map[int]string, opts ...Option) (KeyValueServer, error) {
+	// Open our own raft listener before dialing anyone else's, so peers
+	// racing to dial us during bring-up don't have to wait for us to
+	// finish dialing them first.
+	listener, err := raft.Listen(raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := dialRaftPeers(raftPeers)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	node := raft.New(id, peers)
+	if err := raft.Serve(node, listener); err != nil {
+		return nil, err
+	}
+	kvs := &keyValueServer{
 		store:        store,
 		clients:      make(map[net.Conn]*client),
 		addClient:    make(chan net.Conn),
@@ -60,6 +169,79 @@ func New(store kvstore.KVStore) KeyValueServer {
 		dbRequest:    make(chan *dbOperation),
 		countRequest: make(chan *countQuery),
 		shutdown:     make(chan struct{}),
+		raftNode:     node,
+		peerAddrs:    peerAddrs,
+		raftCommit:   make(chan raft.LogEntry, 256),
+		pendingOps:   make(map[int]*pendingSubmission),
+		leaseRequest: make(chan *leaseOperation),
+		leases:       make(map[int64]*lease),
+		watchRequest: make(chan *watchOperation),
+		watchers:     make(map[string]map[net.Conn]struct{}),
+	}
+	kvs.applyOptions(opts)
+	node.Start()
+	go kvs.forwardCommitsRoutine()
+	return kvs, nil
+}
+
+// dialRaftPeers dials every peer in raftPeers concurrently, each with its
+// own retry-with-backoff, and only fails once one of them has been
+// unreachable for longer than peerDialTimeout.
+func dialRaftPeers(raftPeers map[int]string) (map[int]raft.Peer, error) {
+	type dialResult struct {
+		id   int
+		peer raft.Peer
+		err  error
+	}
+	results := make(chan dialResult, len(raftPeers))
+	for peerID, addr := range raftPeers {
+		go func(peerID int, addr string) {
+			peer, err := dialRaftPeerWithRetry(addr)
+			results <- dialResult{peerID, peer, err}
+		}(peerID, addr)
+	}
+	peers := make(map[int]raft.Peer, len(raftPeers))
+	for range raftPeers {
+		r := <-results
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to dial raft peer %d at %s: %w", r.id, raftPeers[r.id], r.err)
+		}
+		peers[r.id] = r.peer
+	}
+	return peers, nil
+}
+
+// dialRaftPeerWithRetry dials addr, retrying every peerDialRetryInterval
+// until it succeeds or peerDialTimeout has elapsed since the first
+// attempt.
+func dialRaftPeerWithRetry(addr string) (raft.Peer, error) {
+	deadline := time.Now().Add(peerDialTimeout)
+	for {
+		peer, err := raft.DialPeer(addr)
+		if err == nil {
+			return peer, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(peerDialRetryInterval)
+	}
+}
+
+// forwardCommitsRoutine relays entries the raft node has committed into
+// mainRoutine, which is the sole goroutine allowed to touch kvs.store.
+func (kvs *keyValueServer) forwardCommitsRoutine() {
+	for {
+		select {
+		case entry := <-kvs.raftNode.ApplyCh:
+			select {
+			case kvs.raftCommit <- entry:
+			case <-kvs.shutdown:
+				return
+			}
+		case <-kvs.shutdown:
+			return
+		}
 	}
 }
 
@@ -79,18 +261,30 @@ func (kvs *keyValueServer) Close() {
 	if kvs.listener != nil {
 		kvs.listener.Close()
 	}
+	if kvs.raftNode != nil {
+		kvs.raftNode.Stop()
+	}
 	close(kvs.shutdown) // Signal all goroutines to terminate
 }
 
 func (kvs *keyValueServer) CountActive() int {
 	resp := make(chan int)
-	kvs.countRequest <- &countQuery{true, resp}
+	kvs.countRequest <- &countQuery{kind: "active", response: resp}
 	return <-resp
 }
 
 func (kvs *keyValueServer) CountDropped() int {
 	resp := make(chan int)
-	kvs.countRequest <- &countQuery{false, resp}
+	kvs.countRequest <- &countQuery{kind: "dropped", response: resp}
+	return <-resp
+}
+
+// CountDroppedEvents returns the number of watch events dropped because a
+// subscriber's output queue was full, distinct from CountDropped's count
+// of force-disconnected clients.
+func (kvs *keyValueServer) CountDroppedEvents() int {
+	resp := make(chan int)
+	kvs.countRequest <- &countQuery{kind: "droppedEvents", response: resp}
 	return <-resp
 }
 
@@ -116,16 +310,23 @@ func (kvs *keyValueServer) mainRoutine() {
 		select {
 		case conn := <-kvs.addClient:
 			// Create new client with buffered output queue
-			cli := &client{conn, make(chan string, maxQueueSize), make(chan struct{})}
+			cli := &client{conn, make(chan string, maxQueueSize), make(chan struct{}), make(map[string]struct{})}
 			kvs.clients[conn] = cli
 			kvs.countActive++
-			// Start read/write routines for this client
-			go kvs.readRoutine(cli)
-			go kvs.writeRoutine(cli)
+			// Start read/write routines for this client, in whichever
+			// wire protocol this server was configured for.
+			if kvs.protocol == ProtocolBinary {
+				go kvs.readRoutineBinary(cli)
+				go kvs.writeRoutine(cli)
+			} else {
+				go kvs.readRoutine(cli)
+				go kvs.writeRoutine(cli)
+			}
 
 		case conn := <-kvs.removeClient:
 			// Clean up disconnected client
 			if cli, exists := kvs.clients[conn]; exists {
+				kvs.removeWatcherConn(conn, cli.watchedPrefixes)
 				delete(kvs.clients, conn)
 				kvs.countActive--
 				kvs.countDropped++
@@ -134,28 +335,80 @@ func (kvs *keyValueServer) mainRoutine() {
 			}
 
 		case op := <-kvs.dbRequest:
-			// Execute database operation
-			switch op.opType {
-			case "Put":
-				kvs.store.Put(op.key, op.value)
-			case "Get":
-				if op.response != nil {
-					op.response <- kvs.store.Get(op.key)
+			if op.opType == "Txn" {
+				kvs.submitTxn(op)
+				break
+			}
+			if kvs.raftNode == nil {
+				kvs.applyOp(op)
+				break
+			}
+			// Replicated mode: Get is served straight from the local
+			// store under a leader lease (only the leader accepts
+			// client Get traffic in the first place, see readRoutine);
+			// mutations must first commit through raft.
+			if op.opType == "Get" {
+				kvs.applyOp(op)
+				break
+			}
+			kvs.submitOp(op)
+
+		case entry := <-kvs.raftCommit:
+			committed, err := decodeCommand(entry.Command)
+			if err != nil {
+				break
+			}
+			var txnRes *txnResult
+			if committed.opType == "Txn" {
+				txnRes = kvs.applyTxn(committed)
+			} else {
+				kvs.applyOp(committed)
+			}
+			if pending, ok := kvs.pendingOps[entry.Index]; ok {
+				delete(kvs.pendingOps, entry.Index)
+				// A different term's entry may have landed at this log
+				// index than the one pending was submitted under (this
+				// node lost and regained leadership, or another leader's
+				// entry overwrote the uncommitted one) - the command that
+				// just applied isn't pending's command, so fail the
+				// waiter instead of answering with an unrelated result.
+				if pending.term == entry.Term {
+					if pending.op.response != nil {
+						pending.op.response <- nil
+					}
+					if pending.op.txnResponse != nil {
+						pending.op.txnResponse <- txnRes
+					}
+				} else {
+					if pending.op.response != nil {
+						pending.op.response <- nil
+					}
+					if pending.op.txnResponse != nil {
+						pending.op.txnResponse <- nil
+					}
 				}
-			case "Delete":
-				kvs.store.Delete(op.key)
-			case "Update":
-				kvs.store.Update(op.key, op.oldValue, op.newValue)
 			}
 
 		case query := <-kvs.countRequest:
 			// Return requested count
-			if query.isActive {
+			switch query.kind {
+			case "active":
 				query.response <- kvs.countActive
-			} else {
+			case "dropped":
 				query.response <- kvs.countDropped
+			case "droppedEvents":
+				query.response <- kvs.countDroppedEvents
 			}
 
+		case op := <-kvs.leaseRequest:
+			kvs.handleLeaseOp(op)
+
+		case <-kvs.leaseTimerC:
+			kvs.expireDueLeases()
+
+		case op := <-kvs.watchRequest:
+			kvs.handleWatchOp(op)
+
 		case <-kvs.shutdown:
 			// Clean shutdown: close all client connections
 			for conn, cli := range kvs.clients {
@@ -167,6 +420,52 @@ func (kvs *keyValueServer) mainRoutine() {
 	}
 }
 
+// applyOp executes a single database operation against kvs.store. It must
+// only ever be called from mainRoutine, which is the sole owner of store.
+func (kvs *keyValueServer) applyOp(op *dbOperation) {
+	switch op.opType {
+	case "Put":
+		kvs.store.Put(op.key, op.value)
+		kvs.publishMutationEvent(op.opType, op.key, op.value)
+	case "Get":
+		op.revisionAtRead = kvs.revision
+		if op.response != nil {
+			op.response <- kvs.store.Get(op.key)
+		}
+	case "Delete":
+		kvs.store.Delete(op.key)
+		kvs.publishMutationEvent(op.opType, op.key, nil)
+	case "Update":
+		kvs.store.Update(op.key, op.oldValue, op.newValue)
+		kvs.publishMutationEvent(op.opType, op.key, op.newValue)
+	}
+}
+
+// submitOp encodes op and submits it to the raft log, tracking it in
+// pendingOps so the raftCommit case can resolve op.response once it
+// commits. Must only run on mainRoutine, which owns kvs.raftNode and
+// kvs.pendingOps. Safe to call with an op that carries no response
+// channel (e.g. a lease-expiry delete, which nothing is waiting on): a
+// failed or non-leader submission is then simply never observed, same as
+// today.
+func (kvs *keyValueServer) submitOp(op *dbOperation) {
+	command, err := encodeOp(op)
+	if err != nil {
+		if op.response != nil {
+			op.response <- nil
+		}
+		return
+	}
+	index, term, isLeader := kvs.raftNode.Submit(command)
+	if !isLeader {
+		if op.response != nil {
+			op.response <- nil
+		}
+		return
+	}
+	kvs.pendingOps[index] = &pendingSubmission{term: term, op: op}
+}
+
 // readRoutine handles incoming messages from a client
 func (kvs *keyValueServer) readRoutine(cli *client) {
 	defer func() {
@@ -189,11 +488,36 @@ func (kvs *keyValueServer) readRoutine(cli *client) {
 			return
 		default:
 		}
+		if line == "TxnBegin" {
+			kvs.handleTxn(cli, scanner)
+			continue
+		}
+
 		// Parse command: format is "operation:key:value"
 		parts := strings.Split(line, ":")
 		if len(parts) < 2 {
 			continue
 		}
+
+		if leaseOp, ok := parseLeaseCommand(parts); ok {
+			kvs.handleLeaseCommand(cli, parts[0], leaseOp)
+			continue
+		}
+		if putOp, leaseID, ok := parsePutLease(parts); ok {
+			kvs.handlePutLease(cli, putOp, leaseID)
+			continue
+		}
+		if watchOp, ok := parseWatchCommand(cli.conn, parts); ok {
+			select {
+			case kvs.watchRequest <- watchOp:
+			case <-kvs.shutdown:
+				return
+			case <-cli.done:
+				return
+			}
+			continue
+		}
+
 		op := &dbOperation{opType: parts[0], key: parts[1]}
 		switch parts[0] {
 		case "Put":
@@ -213,6 +537,16 @@ func (kvs *keyValueServer) readRoutine(cli *client) {
 		default:
 			continue
 		}
+		if kvs.raftNode != nil {
+			if isLeader, leaderID := kvs.raftNode.Leader(); !isLeader {
+				leaderAddr := kvs.peerAddrs[leaderID]
+				select {
+				case cli.outQueue <- fmt.Sprintf("Leader:%s\n", leaderAddr):
+				default:
+				}
+				continue
+			}
+		}
 		// Send operation to main routine
 		select {
 		case kvs.dbRequest <- op:
@@ -228,7 +562,7 @@ func (kvs *keyValueServer) readRoutine(cli *client) {
 				for _, value := range values {
 					message := strings.TrimSpace(string(value))
 					select {
-					case cli.outQueue <- fmt.Sprintf("%s:%s\n", op.key, message):
+					case cli.outQueue <- fmt.Sprintf("%s:%s:%d\n", op.key, message, op.revisionAtRead):
 						// Successfully queued message for client
 					default:
 						// Output queue full, drop message (slow client handling)
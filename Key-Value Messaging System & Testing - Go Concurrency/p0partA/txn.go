@@ -0,0 +1,371 @@
+package p0partA
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+)
+
+// Wire-format tags distinguishing the two kinds of raft log command,
+// prefixed to every encoded command so forwardCommitsRoutine knows how to
+// decode it.
+const (
+	commandKindOp  byte = 1 // a plain dbOperation (Put/Get/Delete/Update)
+	commandKindTxn byte = 2 // a txnPayload
+)
+
+// txnGuard is one "Compare:key:op:value" condition in a Txn block.
+type txnGuard struct {
+	Key   string
+	Op    string // one of "=", "!=", "<", ">", "exists", "missing"
+	Value []byte
+}
+
+// txnSubOp is a Put/Delete/Update/Get inside a Txn's Then or Else branch.
+// It mirrors dbOperation's fields but, unlike dbOperation, is made only of
+// exported fields so it survives a gob round trip through the raft log.
+type txnSubOp struct {
+	OpType   string
+	Key      string
+	Value    []byte
+	OldValue []byte
+	NewValue []byte
+}
+
+// txnPayload is the gob-encodable contents of a Txn dbOperation.
+type txnPayload struct {
+	Guards  []txnGuard
+	ThenOps []txnSubOp
+	ElseOps []txnSubOp
+}
+
+// txnGetResult is one Get executed as part of a Txn branch.
+type txnGetResult struct {
+	key      string
+	values   [][]byte
+	revision int64 // kvs.revision as of this Get, same as a standalone Get's trailing field
+}
+
+// txnResult is delivered back to the submitting client once a Txn has
+// been applied.
+type txnResult struct {
+	succeeded  bool
+	getResults []txnGetResult
+}
+
+// encodeOp gob-encodes the fields of op that must survive a round trip
+// through the raft log, tagged as a plain operation.
+func encodeOp(op *dbOperation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(commandKindOp)
+	if err := gob.NewEncoder(&buf).Encode(struct {
+		OpType   string
+		Key      string
+		Value    []byte
+		OldValue []byte
+		NewValue []byte
+	}{op.opType, op.key, op.value, op.oldValue, op.newValue}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeTxnOp gob-encodes a Txn dbOperation's guards and branches, tagged
+// as a transaction.
+func encodeTxnOp(op *dbOperation) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(commandKindTxn)
+	if err := gob.NewEncoder(&buf).Encode(txnPayload{
+		Guards:  op.txnGuards,
+		ThenOps: toWireOps(op.txnThenOps),
+		ElseOps: toWireOps(op.txnElseOps),
+	}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func toWireOps(ops []*dbOperation) []txnSubOp {
+	wire := make([]txnSubOp, len(ops))
+	for i, op := range ops {
+		wire[i] = txnSubOp{op.opType, op.key, op.value, op.oldValue, op.newValue}
+	}
+	return wire
+}
+
+func fromWireOps(wire []txnSubOp) []*dbOperation {
+	ops := make([]*dbOperation, len(wire))
+	for i, w := range wire {
+		ops[i] = &dbOperation{opType: w.OpType, key: w.Key, value: w.Value, oldValue: w.OldValue, newValue: w.NewValue}
+	}
+	return ops
+}
+
+// decodeCommand inspects the leading tag byte and decodes command into
+// either a plain dbOperation or a Txn dbOperation.
+func decodeCommand(command []byte) (*dbOperation, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("empty raft command")
+	}
+	body := bytes.NewReader(command[1:])
+	switch command[0] {
+	case commandKindOp:
+		var decoded struct {
+			OpType   string
+			Key      string
+			Value    []byte
+			OldValue []byte
+			NewValue []byte
+		}
+		if err := gob.NewDecoder(body).Decode(&decoded); err != nil {
+			return nil, err
+		}
+		return &dbOperation{
+			opType:   decoded.OpType,
+			key:      decoded.Key,
+			value:    decoded.Value,
+			oldValue: decoded.OldValue,
+			newValue: decoded.NewValue,
+		}, nil
+
+	case commandKindTxn:
+		var payload txnPayload
+		if err := gob.NewDecoder(body).Decode(&payload); err != nil {
+			return nil, err
+		}
+		return &dbOperation{
+			opType:      "Txn",
+			txnGuards:   payload.Guards,
+			txnThenOps:  fromWireOps(payload.ThenOps),
+			txnElseOps:  fromWireOps(payload.ElseOps),
+			txnResponse: nil, // filled in by the submitting node's pendingOps entry, not the wire
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown raft command tag %d", command[0])
+	}
+}
+
+// handleTxn reads the TxnBegin block cli just sent, submits it, and
+// writes the TxnResult (and any embedded Get output) back to cli.
+func (kvs *keyValueServer) handleTxn(cli *client, scanner *bufio.Scanner) {
+	op := readTxnBlock(scanner)
+	if op == nil {
+		return // malformed block or connection closed before TxnEnd
+	}
+	if kvs.raftNode != nil {
+		if isLeader, leaderID := kvs.raftNode.Leader(); !isLeader {
+			leaderAddr := kvs.peerAddrs[leaderID]
+			select {
+			case cli.outQueue <- fmt.Sprintf("Leader:%s\n", leaderAddr):
+			default:
+			}
+			return
+		}
+	}
+	select {
+	case kvs.dbRequest <- op:
+	case <-kvs.shutdown:
+		return
+	case <-cli.done:
+		return
+	}
+	select {
+	case result := <-op.txnResponse:
+		if result == nil {
+			return
+		}
+		select {
+		case cli.outQueue <- txnResultLine(result):
+		default:
+		}
+	case <-kvs.shutdown:
+	case <-cli.done:
+	}
+}
+
+// submitTxn is mainRoutine's entry point for a Txn dbOperation pulled off
+// kvs.dbRequest: applied directly in standalone mode, or submitted to the
+// raft log in replicated mode so every replica evaluates the same guards
+// against identical state.
+func (kvs *keyValueServer) submitTxn(op *dbOperation) {
+	if kvs.raftNode == nil {
+		result := kvs.applyTxn(op)
+		if op.txnResponse != nil {
+			op.txnResponse <- result
+		}
+		return
+	}
+	command, err := encodeTxnOp(op)
+	if err != nil {
+		if op.txnResponse != nil {
+			op.txnResponse <- nil
+		}
+		return
+	}
+	index, term, isLeader := kvs.raftNode.Submit(command)
+	if !isLeader {
+		if op.txnResponse != nil {
+			op.txnResponse <- nil
+		}
+		return
+	}
+	kvs.pendingOps[index] = &pendingSubmission{term: term, op: op}
+}
+
+// applyTxn evaluates op's guards against kvs.store and applies exactly one
+// branch. Like applyOp, it must only ever run on mainRoutine.
+func (kvs *keyValueServer) applyTxn(op *dbOperation) *txnResult {
+	succeeded := true
+	for _, guard := range op.txnGuards {
+		if !kvs.evalGuard(guard) {
+			succeeded = false
+			break
+		}
+	}
+	branch := op.txnThenOps
+	if !succeeded {
+		branch = op.txnElseOps
+	}
+	result := &txnResult{succeeded: succeeded}
+	for _, subOp := range branch {
+		if subOp.opType == "Get" {
+			subOp.response = make(chan [][]byte, 1)
+			kvs.applyOp(subOp)
+			result.getResults = append(result.getResults, txnGetResult{key: subOp.key, values: <-subOp.response, revision: subOp.revisionAtRead})
+			continue
+		}
+		kvs.applyOp(subOp)
+	}
+	return result
+}
+
+func (kvs *keyValueServer) evalGuard(guard txnGuard) bool {
+	values := kvs.store.Get(guard.Key)
+	exists := len(values) > 0
+	switch guard.Op {
+	case "exists":
+		return exists
+	case "missing":
+		return !exists
+	}
+	var current []byte
+	if exists {
+		current = values[0]
+	}
+	switch guard.Op {
+	case "=":
+		return exists && bytes.Equal(current, guard.Value)
+	case "!=":
+		return !exists || !bytes.Equal(current, guard.Value)
+	case "<":
+		return exists && bytes.Compare(current, guard.Value) < 0
+	case ">":
+		return exists && bytes.Compare(current, guard.Value) > 0
+	default:
+		return false
+	}
+}
+
+// txnResultLine formats the TxnResult response line for a client,
+// including one line per Get executed in the branch that ran. Each Get
+// line carries the same trailing revision field as a standalone Get
+// response, so a client doesn't need two different parsers for the two
+// cases.
+func txnResultLine(result *txnResult) string {
+	var buf strings.Builder
+	if result.succeeded {
+		buf.WriteString("TxnResult:succeeded\n")
+	} else {
+		buf.WriteString("TxnResult:failed\n")
+	}
+	for _, get := range result.getResults {
+		for _, value := range get.values {
+			fmt.Fprintf(&buf, "%s:%s:%d\n", get.key, strings.TrimSpace(string(value)), get.revision)
+		}
+	}
+	return buf.String()
+}
+
+// readTxnBlock consumes lines from scanner, starting just after a
+// "TxnBegin" line, until a matching "TxnEnd", and parses the Compare/Then/
+// Else sections into a Txn dbOperation. Returns nil if the block is
+// malformed or the connection closes before TxnEnd arrives.
+func readTxnBlock(scanner *bufio.Scanner) *dbOperation {
+	var guards []txnGuard
+	var thenOps, elseOps []*dbOperation
+	section := "compare" // "compare" -> "then" -> "else"
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "TxnEnd" {
+			return &dbOperation{
+				opType:      "Txn",
+				txnGuards:   guards,
+				txnThenOps:  thenOps,
+				txnElseOps:  elseOps,
+				txnResponse: make(chan *txnResult, 1),
+			}
+		}
+		if line == "Then" {
+			section = "then"
+			continue
+		}
+		if line == "Else" {
+			section = "else"
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		switch section {
+		case "compare":
+			if parts[0] != "Compare" || len(parts) < 4 {
+				continue
+			}
+			guards = append(guards, txnGuard{Key: parts[1], Op: parts[2], Value: []byte(strings.Join(parts[3:], ":"))})
+		case "then", "else":
+			subOp, ok := parseTxnSubOp(parts)
+			if !ok {
+				continue
+			}
+			if section == "then" {
+				thenOps = append(thenOps, subOp)
+			} else {
+				elseOps = append(elseOps, subOp)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTxnSubOp parses one Put/Delete/Update/Get line inside a Then/Else
+// block, reusing the same wire format as the top-level text protocol.
+func parseTxnSubOp(parts []string) (*dbOperation, bool) {
+	if len(parts) < 2 {
+		return nil, false
+	}
+	op := &dbOperation{opType: parts[0], key: parts[1]}
+	switch parts[0] {
+	case "Put":
+		if len(parts) < 3 {
+			return nil, false
+		}
+		op.value = []byte(strings.Join(parts[2:], ":"))
+	case "Get":
+	case "Delete":
+	case "Update":
+		if len(parts) < 4 {
+			return nil, false
+		}
+		op.oldValue = []byte(parts[2])
+		op.newValue = []byte(strings.Join(parts[3:], ":"))
+	default:
+		return nil, false
+	}
+	return op, true
+}
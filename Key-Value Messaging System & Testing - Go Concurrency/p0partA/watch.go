@@ -0,0 +1,159 @@
+package p0partA
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// eventRingCapacity bounds how many past mutation events WatchFrom can
+// replay; older events are simply unavailable to late subscribers.
+const eventRingCapacity = 1000
+
+// watchEvent is one committed mutation, as delivered to subscribers and
+// retained in the replay ring buffer.
+type watchEvent struct {
+	typ      string // "PUT" or "DEL"
+	key      string
+	value    []byte
+	revision int64
+}
+
+// watchOperation is sent on watchRequest and handled by mainRoutine, which
+// owns kvs.watchers and kvs.eventRing alongside kvs.store.
+type watchOperation struct {
+	opType       string // "Watch", "Unwatch", "WatchFrom"
+	conn         net.Conn
+	prefix       string
+	fromRevision int64
+}
+
+// handleWatchOp services a watchOperation. Caller (mainRoutine) must hold
+// no locks; kvs.watchers/kvs.eventRing are only ever touched here.
+func (kvs *keyValueServer) handleWatchOp(op *watchOperation) {
+	cli, ok := kvs.clients[op.conn]
+	if !ok {
+		return // client disconnected before mainRoutine got to this request
+	}
+	switch op.opType {
+	case "Watch", "WatchFrom":
+		if kvs.watchers[op.prefix] == nil {
+			kvs.watchers[op.prefix] = make(map[net.Conn]struct{})
+		}
+		kvs.watchers[op.prefix][op.conn] = struct{}{}
+		cli.watchedPrefixes[op.prefix] = struct{}{}
+		if op.opType == "WatchFrom" {
+			kvs.replayEvents(cli, op.prefix, op.fromRevision)
+		}
+
+	case "Unwatch":
+		if conns, ok := kvs.watchers[op.prefix]; ok {
+			delete(conns, op.conn)
+			if len(conns) == 0 {
+				delete(kvs.watchers, op.prefix)
+			}
+		}
+		delete(cli.watchedPrefixes, op.prefix)
+	}
+}
+
+// removeWatcherConn drops every subscription conn held, called when a
+// client disconnects.
+func (kvs *keyValueServer) removeWatcherConn(conn net.Conn, prefixes map[string]struct{}) {
+	for prefix := range prefixes {
+		if conns, ok := kvs.watchers[prefix]; ok {
+			delete(conns, conn)
+			if len(conns) == 0 {
+				delete(kvs.watchers, prefix)
+			}
+		}
+	}
+}
+
+// replayEvents sends cli every retained event at or after fromRevision
+// whose key matches prefix, oldest first.
+func (kvs *keyValueServer) replayEvents(cli *client, prefix string, fromRevision int64) {
+	for _, evt := range kvs.eventRing {
+		if evt.revision < fromRevision || !strings.HasPrefix(evt.key, prefix) {
+			continue
+		}
+		kvs.deliverEvent(cli, evt)
+	}
+}
+
+// publishMutationEvent advances the server's revision counter and fans the
+// resulting event out to every watcher whose prefix matches key. Called
+// from applyOp, so it only ever runs on mainRoutine.
+func (kvs *keyValueServer) publishMutationEvent(opType, key string, value []byte) {
+	kvs.revision++
+	evtType := "PUT"
+	if opType == "Delete" {
+		evtType = "DEL"
+	}
+	evt := watchEvent{typ: evtType, key: key, value: value, revision: kvs.revision}
+	kvs.recordEvent(evt)
+
+	for prefix, conns := range kvs.watchers {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for conn := range conns {
+			if cli, ok := kvs.clients[conn]; ok {
+				kvs.deliverEvent(cli, evt)
+			}
+		}
+	}
+}
+
+// deliverEvent enqueues evt on cli.outQueue, dropping it and counting the
+// drop in countDroppedEvents if the client is too slow to keep up - the
+// same "queue full -> drop" policy already applied to every other
+// outgoing message, but counted separately from countDropped, which
+// tracks force-disconnected clients rather than individual dropped
+// messages.
+func (kvs *keyValueServer) deliverEvent(cli *client, evt watchEvent) {
+	line := fmt.Sprintf("Event:%s:%s:%s\n", evt.typ, evt.key, strings.TrimSpace(string(evt.value)))
+	select {
+	case cli.outQueue <- line:
+	default:
+		kvs.countDroppedEvents++
+	}
+}
+
+// recordEvent appends evt to the bounded replay ring buffer, evicting the
+// oldest event once capacity is reached.
+func (kvs *keyValueServer) recordEvent(evt watchEvent) {
+	kvs.eventRing = append(kvs.eventRing, evt)
+	if len(kvs.eventRing) > eventRingCapacity {
+		kvs.eventRing = kvs.eventRing[len(kvs.eventRing)-eventRingCapacity:]
+	}
+}
+
+// parseWatchCommand recognizes Watch/Unwatch/WatchFrom protocol lines.
+func parseWatchCommand(conn net.Conn, parts []string) (*watchOperation, bool) {
+	switch parts[0] {
+	case "Watch":
+		if len(parts) < 2 {
+			return nil, false
+		}
+		return &watchOperation{opType: "Watch", conn: conn, prefix: parts[1]}, true
+
+	case "Unwatch":
+		if len(parts) < 2 {
+			return nil, false
+		}
+		return &watchOperation{opType: "Unwatch", conn: conn, prefix: parts[1]}, true
+
+	case "WatchFrom":
+		if len(parts) < 3 {
+			return nil, false
+		}
+		rev, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return &watchOperation{opType: "WatchFrom", conn: conn, prefix: parts[1], fromRevision: rev}, true
+	}
+	return nil, false
+}